@@ -0,0 +1,87 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, DCSO GmbH
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/DCSO/fever/rpc"
+)
+
+func TestNewlineJSONEncoder(t *testing.T) {
+	enc := NewlineJSONEncoder{}
+	out, err := enc.EncodeBatch([][]byte{[]byte(`{"a":1}`), []byte(`{"b":2}`)})
+	if err != nil {
+		t.Fatalf("EncodeBatch: %s", err)
+	}
+	want := "{\"a\":1}\n{\"b\":2}\n"
+	if string(out) != want {
+		t.Fatalf("got %q, want %q", out, want)
+	}
+}
+
+func TestLengthPrefixedEncoder(t *testing.T) {
+	enc := LengthPrefixedEncoder{}
+	out, err := enc.EncodeBatch([][]byte{[]byte("ab"), []byte("cde")})
+	if err != nil {
+		t.Fatalf("EncodeBatch: %s", err)
+	}
+
+	r := bytes.NewReader(out)
+	for _, want := range []string{"ab", "cde"} {
+		var lenBuf [4]byte
+		if _, err := r.Read(lenBuf[:]); err != nil {
+			t.Fatalf("reading length prefix: %s", err)
+		}
+		n := binary.BigEndian.Uint32(lenBuf[:])
+		buf := make([]byte, n)
+		if _, err := r.Read(buf); err != nil {
+			t.Fatalf("reading payload: %s", err)
+		}
+		if string(buf) != want {
+			t.Fatalf("got %q, want %q", buf, want)
+		}
+	}
+}
+
+// TestProtobufEncoderRoundTrip verifies that ProtobufEncoder breaks out
+// event_type into rpc.Entry's typed field, rather than only wrapping the
+// raw JSON opaquely, and that the length-prefixed framing it writes can be
+// read back and decoded into the original batch.
+func TestProtobufEncoderRoundTrip(t *testing.T) {
+	enc := ProtobufEncoder{}
+	items := [][]byte{
+		[]byte(`{"event_type":"alert","signature":"x"}`),
+		[]byte(`{"event_type":"dns","rrname":"example.com"}`),
+	}
+	framed, err := enc.EncodeBatch(items)
+	if err != nil {
+		t.Fatalf("EncodeBatch: %s", err)
+	}
+
+	if len(framed) < 4 {
+		t.Fatalf("framed output too short: %d bytes", len(framed))
+	}
+	msgLen := binary.BigEndian.Uint32(framed[:4])
+	msg := framed[4 : 4+msgLen]
+
+	var batch rpc.EntryBatch
+	if err := batch.Unmarshal(msg); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if len(batch.Entries) != len(items) {
+		t.Fatalf("got %d entries, want %d", len(batch.Entries), len(items))
+	}
+	wantTypes := []string{"alert", "dns"}
+	for i, e := range batch.Entries {
+		if e.EventType != wantTypes[i] {
+			t.Errorf("entry %d: got EventType %q, want %q", i, e.EventType, wantTypes[i])
+		}
+		if !bytes.Equal(e.JSONLine, items[i]) {
+			t.Errorf("entry %d: JSONLine does not round-trip", i)
+		}
+	}
+}
@@ -4,7 +4,13 @@ package processing
 // Copyright (c) 2017, DCSO GmbH
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"net"
+	"net/url"
+	"os"
 	"sync"
 	"time"
 
@@ -14,38 +20,214 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// DefaultForwardStopDeadline is the flush deadline used by Stop when
+// StopDeadline is left at its zero value.
+const DefaultForwardStopDeadline = 5 * time.Second
+
 // ForwardHandlerPerfStats contains performance stats written to InfluxDB
-// for monitoring.
+// for monitoring. Sink is tagged rather than a field so that a ForwardRouter
+// fanning out to several named sinks is reported as distinct series.
 type ForwardHandlerPerfStats struct {
+	Sink            string `influx:"sink,tag"`
 	ForwardedPerSec uint64 `influx:"forwarded_events_per_sec"`
+	DroppedPerSec   uint64 `influx:"dropped_events_per_sec"`
+	QueueLen        uint64 `influx:"forward_queue_len"`
+	ReconnectCount  uint64 `influx:"forward_reconnect_count"`
+}
+
+// ForwardTLSConfig bundles the mutual-TLS parameters used when dialing a
+// `tls://` output target.
+type ForwardTLSConfig struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	VerifyPeer bool
+	ALPN       []string
 }
 
 // ForwardHandler is a handler that processes events by writing their JSON
-// representation into a UNIX socket. This is limited by a list of allowed
-// event types to be forwarded.
+// representation into an output connection. This is limited by a list of
+// allowed event types to be forwarded. The output target is given either as
+// a plain UNIX socket path (legacy behavior) or as a URL via
+// MakeForwardHandlerWithURL, supporting `unix://`, `tcp://` and `tls://`
+// schemes.
+//
+// By default Consume blocks the caller once ForwardEventChan is full. If
+// NonBlocking is set, events are instead dropped (counted in
+// PerfStats.DroppedPerSec) or, if a Spool is configured, appended to disk
+// and replayed once the output connection is available again.
+//
+// Run/Stop may be called repeatedly; Stop cancels all of the handler's
+// goroutines via context, waits for them to exit, then drains
+// ForwardEventChan (writing live or spooling each remaining item) up to
+// StopDeadline before returning.
 type ForwardHandler struct {
 	Logger              *log.Entry
 	ForwardEventChan    chan []byte
 	OutputSocket        string
+	OutputURL           string
+	TLSConfig           ForwardTLSConfig
+	dial                func() (net.Conn, error)
 	OutputConn          net.Conn
 	Reconnecting        bool
 	ReconnLock          sync.Mutex
 	ReconnectNotifyChan chan bool
-	StopReconnectChan   chan bool
 	ReconnectTimes      int
+	NonBlocking         bool
+	Spool               *DiskSpool
+	Encoder             ForwardEncoder
+	BatchSize           int
+	ChanCapacity        int
+	StopDeadline        time.Duration
 	PerfStats           ForwardHandlerPerfStats
 	StatsEncoder        *util.PerformanceStatsEncoder
-	StopChan            chan bool
-	StoppedChan         chan bool
 	Running             bool
 	Lock                sync.Mutex
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	produceWG sync.WaitGroup
 }
 
-func (fh *ForwardHandler) reconnectForward() {
-	for range fh.ReconnectNotifyChan {
+// SetSpoolDir enables disk spooling of events that cannot be delivered or
+// queued, storing segments under dir. maxSegmentBytes bounds the size of a
+// single segment file before it is rotated, maxBytes bounds the spool's
+// total on-disk size (oldest segments are evicted first), and
+// fsyncInterval controls how often the current segment is flushed to disk
+// (0 disables periodic fsync).
+func (fh *ForwardHandler) SetSpoolDir(dir string, maxSegmentBytes, maxBytes int64, fsyncInterval time.Duration) error {
+	spool, err := NewDiskSpool(dir, maxSegmentBytes, maxBytes, fsyncInterval)
+	if err != nil {
+		return err
+	}
+	fh.Spool = spool
+	return nil
+}
+
+// parseOutputURL turns a target URL into a dial function for the
+// corresponding transport. Supported schemes are `unix://`, `tcp://` and
+// `tls://` (mutual TLS, configured via query parameters `ca`, `cert`, `key`
+// and `verifypeer`).
+func parseOutputURL(rawURL string) (func() (net.Conn, error), error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output URL %q: %w", rawURL, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		if path == "" {
+			path = u.Opaque
+		}
+		return func() (net.Conn, error) {
+			return net.Dial("unix", path)
+		}, nil
+	case "tcp":
+		host := u.Host
+		return func() (net.Conn, error) {
+			return net.Dial("tcp", host)
+		}, nil
+	case "tls":
+		host := u.Host
+		q := u.Query()
+		tlsCfg, err := makeTLSConfig(ForwardTLSConfig{
+			CAFile:     q.Get("ca"),
+			CertFile:   q.Get("cert"),
+			KeyFile:    q.Get("key"),
+			VerifyPeer: q.Get("verifypeer") != "false",
+			ALPN:       q["alpn"],
+		})
+		if err != nil {
+			return nil, err
+		}
+		return func() (net.Conn, error) {
+			return tls.Dial("tcp", host, tlsCfg)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported output scheme %q", u.Scheme)
+	}
+}
+
+// makeTLSConfig builds a *tls.Config implementing mutual TLS from the given
+// ForwardTLSConfig, loading the client certificate and CA pool from disk.
+func makeTLSConfig(cfg ForwardTLSConfig) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		InsecureSkipVerify: !cfg.VerifyPeer,
+		NextProtos:         cfg.ALPN,
+	}
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client keypair: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.CAFile != "" {
+		caBytes, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("no valid certificates found in %s", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	return tlsCfg, nil
+}
+
+// dialResult carries the outcome of a dial attempt made in the background
+// so that it can be abandoned without blocking a caller that loses
+// interest (e.g. because ctx was canceled).
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialContext runs fh.dial() in the background and returns as soon as
+// either it completes or ctx is done. If ctx wins the race, any connection
+// that the dial eventually produces is closed rather than leaked.
+func (fh *ForwardHandler) dialContext(ctx context.Context) (net.Conn, error) {
+	resultChan := make(chan dialResult, 1)
+	go func() {
+		conn, err := fh.dial()
+		resultChan <- dialResult{conn, err}
+	}()
+	select {
+	case res := <-resultChan:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-resultChan; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// notifyReconnect signals reconnectForward to (re)connect, without blocking
+// forever if ctx has already been canceled.
+func (fh *ForwardHandler) notifyReconnect(ctx context.Context) {
+	select {
+	case fh.ReconnectNotifyChan <- true:
+	case <-ctx.Done():
+	}
+}
+
+func (fh *ForwardHandler) reconnectForward(ctx context.Context) {
+	defer fh.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-fh.ReconnectNotifyChan:
+		}
+
 		var i int
 		log.Info("Reconnecting to forwarding socket...")
-		outputConn, myerror := net.Dial("unix", fh.OutputSocket)
+		outputConn, myerror := fh.dialContext(ctx)
 		fh.ReconnLock.Lock()
 		if !fh.Reconnecting {
 			fh.Reconnecting = true
@@ -56,7 +238,7 @@ func (fh *ForwardHandler) reconnectForward() {
 		fh.ReconnLock.Unlock()
 		for i = 0; (fh.ReconnectTimes == 0 || i < fh.ReconnectTimes) && myerror != nil; i++ {
 			select {
-			case <-fh.StopReconnectChan:
+			case <-ctx.Done():
 				return
 			default:
 				log.WithFields(log.Fields{
@@ -64,8 +246,12 @@ func (fh *ForwardHandler) reconnectForward() {
 					"retry":      i + 1,
 					"maxretries": fh.ReconnectTimes,
 				}).Warnf("error connecting to output socket, retrying: %s", myerror)
-				time.Sleep(10 * time.Second)
-				outputConn, myerror = net.Dial("unix", fh.OutputSocket)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(10 * time.Second):
+				}
+				outputConn, myerror = fh.dialContext(ctx)
 			}
 		}
 		if myerror != nil {
@@ -82,7 +268,11 @@ func (fh *ForwardHandler) reconnectForward() {
 			}
 			fh.Lock.Lock()
 			fh.OutputConn = outputConn
+			fh.PerfStats.ReconnectCount++
 			fh.Lock.Unlock()
+			if fh.Spool != nil {
+				fh.replaySpool()
+			}
 			fh.ReconnLock.Lock()
 			fh.Reconnecting = false
 			fh.ReconnLock.Unlock()
@@ -90,72 +280,172 @@ func (fh *ForwardHandler) reconnectForward() {
 	}
 }
 
-func (fh *ForwardHandler) runForward() {
-	var err error
+// replaySpool drains any events buffered on disk into the output
+// connection before regular forwarding resumes. Events are written
+// directly (bypassing ForwardEventChan) so that replay cannot itself fill
+// up the spool again.
+func (fh *ForwardHandler) replaySpool() {
+	encoder := fh.Encoder
+	if encoder == nil {
+		encoder = NewlineJSONEncoder{}
+	}
+	err := fh.Spool.Replay(func(item []byte) error {
+		payload, err := encoder.EncodeBatch([][]byte{item})
+		if err != nil {
+			return err
+		}
+		fh.Lock.Lock()
+		defer fh.Lock.Unlock()
+		if fh.OutputConn == nil {
+			return fmt.Errorf("no output connection available for replay")
+		}
+		_, err = fh.OutputConn.Write(payload)
+		return err
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"domain": "forward",
+		}).Warnf("spool replay interrupted, will retry on next reconnect: %s", err)
+	}
+}
+
+func (fh *ForwardHandler) runForward(ctx context.Context) {
+	defer fh.wg.Done()
 	for {
 		select {
-		case <-fh.StopChan:
-			close(fh.StoppedChan)
+		case <-ctx.Done():
 			return
-		default:
-			for item := range fh.ForwardEventChan {
-				select {
-				case <-fh.StopChan:
-					close(fh.StoppedChan)
-					return
-				default:
-					fh.ReconnLock.Lock()
-					if fh.Reconnecting {
-						fh.ReconnLock.Unlock()
-						continue
-					}
-					fh.ReconnLock.Unlock()
-					fh.Lock.Lock()
-					if fh.OutputConn != nil {
-						_, err = fh.OutputConn.Write(item)
-						if err != nil {
-							fh.OutputConn.Close()
-							log.Warn(err)
-							fh.ReconnectNotifyChan <- true
-							fh.Lock.Unlock()
-							continue
-						}
-						_, err = fh.OutputConn.Write([]byte("\n"))
-						if err != nil {
-							fh.OutputConn.Close()
-							log.Warn(err)
-							fh.Lock.Unlock()
-							continue
-						}
-					}
-					fh.Lock.Unlock()
-				}
+		case item, ok := <-fh.ForwardEventChan:
+			if !ok {
+				return
+			}
+			fh.ReconnLock.Lock()
+			if fh.Reconnecting {
+				fh.ReconnLock.Unlock()
+				fh.spoolOrDrop(item)
+				continue
+			}
+			fh.ReconnLock.Unlock()
+			fh.writeBatch(ctx, fh.collectBatch(item))
+		}
+	}
+}
+
+// collectBatch gathers up to BatchSize items (including the already
+// received first one) from ForwardEventChan without blocking, so that a
+// quiet channel doesn't delay delivery of the first item while waiting for
+// more to arrive.
+func (fh *ForwardHandler) collectBatch(first []byte) [][]byte {
+	limit := fh.BatchSize
+	if limit < 1 {
+		limit = 1
+	}
+	return collectBatch(fh.ForwardEventChan, first, limit)
+}
+
+// collectBatch gathers up to limit items (including the already received
+// first one) from ch without blocking.
+func collectBatch(ch chan []byte, first []byte, limit int) [][]byte {
+	batch := make([][]byte, 1, limit)
+	batch[0] = first
+	for len(batch) < limit {
+		select {
+		case item, ok := <-ch:
+			if !ok {
+				return batch
 			}
+			batch = append(batch, item)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// writeBatch encodes batch with the handler's configured ForwardEncoder
+// (NewlineJSONEncoder by default) and writes it to the output connection in
+// a single call. On any failure the batch is spooled (or dropped) and, for
+// a write error, a reconnect is triggered.
+func (fh *ForwardHandler) writeBatch(ctx context.Context, batch [][]byte) {
+	encoder := fh.Encoder
+	if encoder == nil {
+		encoder = NewlineJSONEncoder{}
+	}
+	payload, err := encoder.EncodeBatch(batch)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"domain": "forward",
+		}).Warnf("failed to encode forward batch: %s", err)
+		for _, item := range batch {
+			fh.spoolOrDrop(item)
+		}
+		return
+	}
+
+	fh.Lock.Lock()
+	if fh.OutputConn == nil {
+		fh.Lock.Unlock()
+		for _, item := range batch {
+			fh.spoolOrDrop(item)
+		}
+		return
+	}
+	_, err = fh.OutputConn.Write(payload)
+	fh.Lock.Unlock()
+	if err != nil {
+		fh.Lock.Lock()
+		fh.OutputConn.Close()
+		fh.Lock.Unlock()
+		log.Warn(err)
+		for _, item := range batch {
+			fh.spoolOrDrop(item)
 		}
+		fh.notifyReconnect(ctx)
 	}
 }
 
-func (fh *ForwardHandler) runCounter() {
+// spoolOrDrop is the fallback path for an event that cannot currently be
+// written to the output connection. If a disk spool is configured the
+// event is appended there for later replay; otherwise it is dropped and
+// counted in PerfStats.DroppedPerSec.
+func (fh *ForwardHandler) spoolOrDrop(item []byte) {
+	if fh.Spool != nil {
+		if err := fh.Spool.Write(item); err == nil {
+			return
+		}
+		log.WithFields(log.Fields{
+			"domain": "forward",
+		}).Warnf("failed to spool event to disk, dropping")
+	}
+	fh.Lock.Lock()
+	fh.PerfStats.DroppedPerSec++
+	fh.Lock.Unlock()
+}
+
+func (fh *ForwardHandler) runCounter(ctx context.Context) {
+	defer fh.wg.Done()
 	var nofSecs uint64 = 10
 	for {
 		select {
-		case <-fh.StopChan:
+		case <-ctx.Done():
 			return
-		default:
-			time.Sleep(time.Duration(nofSecs) * time.Second)
+		case <-time.After(time.Duration(nofSecs) * time.Second):
 			fh.Lock.Lock()
+			fh.PerfStats.QueueLen = uint64(len(fh.ForwardEventChan))
 			if fh.StatsEncoder != nil {
 				fh.PerfStats.ForwardedPerSec /= nofSecs
+				fh.PerfStats.DroppedPerSec /= nofSecs
 				fh.StatsEncoder.Submit(fh.PerfStats)
 			}
 			fh.PerfStats.ForwardedPerSec = 0
+			fh.PerfStats.DroppedPerSec = 0
 			fh.Lock.Unlock()
-
 		}
 	}
 }
 
-// MakeForwardHandler creates a new forwarding handler
+// MakeForwardHandler creates a new forwarding handler that dials a UNIX
+// socket at outputSocket.
 func MakeForwardHandler(reconnectTimes int, outputSocket string) *ForwardHandler {
 	fh := &ForwardHandler{
 		Logger: log.WithFields(log.Fields{
@@ -164,25 +454,97 @@ func MakeForwardHandler(reconnectTimes int, outputSocket string) *ForwardHandler
 		OutputSocket:        outputSocket,
 		ReconnectTimes:      reconnectTimes,
 		ReconnectNotifyChan: make(chan bool),
-		StopReconnectChan:   make(chan bool),
+		Encoder:             NewlineJSONEncoder{},
+		BatchSize:           1,
+	}
+	fh.dial = func() (net.Conn, error) {
+		return net.Dial("unix", fh.OutputSocket)
 	}
 	return fh
 }
 
-// Consume processes an Entry and forwards it
+// MakeForwardHandlerWithURL creates a new forwarding handler that dials the
+// target described by outputURL. Supported schemes are `unix://`, `tcp://`
+// and `tls://`, the latter supporting mutual TLS via the `ca`, `cert`, `key`,
+// `verifypeer` and `alpn` query parameters.
+func MakeForwardHandlerWithURL(reconnectTimes int, outputURL string) (*ForwardHandler, error) {
+	dial, err := parseOutputURL(outputURL)
+	if err != nil {
+		return nil, err
+	}
+	fh := &ForwardHandler{
+		Logger: log.WithFields(log.Fields{
+			"domain": "forward",
+		}),
+		OutputURL:           outputURL,
+		ReconnectTimes:      reconnectTimes,
+		ReconnectNotifyChan: make(chan bool),
+		dial:                dial,
+		Encoder:             NewlineJSONEncoder{},
+		BatchSize:           1,
+	}
+	return fh, nil
+}
+
+// Consume processes an Entry and forwards it. In the default (blocking)
+// mode this may block the caller if ForwardEventChan is full; with
+// NonBlocking set, a full queue instead spools (or drops) the event via
+// spoolOrDrop. If the handler isn't running, the event is spooled (or
+// dropped) directly rather than queued for a forwarder that isn't reading.
 func (fh *ForwardHandler) Consume(e *types.Entry) error {
 	doForwardThis := util.ForwardAllEvents || util.AllowType(e.EventType)
 	if doForwardThis {
 		jsonCopy := make([]byte, len(e.JSONLine))
 		copy(jsonCopy, e.JSONLine)
-		fh.ForwardEventChan <- jsonCopy
-		fh.Lock.Lock()
-		fh.PerfStats.ForwardedPerSec++
-		fh.Lock.Unlock()
+		fh.enqueue(jsonCopy)
 	}
 	return nil
 }
 
+// enqueue pushes a pre-copied JSON payload onto ForwardEventChan, honoring
+// NonBlocking/Spool semantics. Shared by Consume and ForwardRouterSink.consume
+// so the Stop/Consume race-safety below has a single implementation.
+//
+// The running check and produceWG.Add must happen in the same critical
+// section as Stop's own Running flip, so that Stop can never start draining
+// ForwardEventChan while a caller that saw Running == true hasn't yet
+// enqueued (or bailed out) -- see produceWG.Wait in Stop.
+func (fh *ForwardHandler) enqueue(jsonCopy []byte) {
+	fh.Lock.Lock()
+	if !fh.Running {
+		fh.Lock.Unlock()
+		fh.spoolOrDrop(jsonCopy)
+		return
+	}
+	fh.produceWG.Add(1)
+	ch := fh.ForwardEventChan
+	ctx := fh.ctx
+	fh.Lock.Unlock()
+	defer fh.produceWG.Done()
+
+	if fh.NonBlocking {
+		select {
+		case ch <- jsonCopy:
+		default:
+			fh.spoolOrDrop(jsonCopy)
+			return
+		}
+	} else {
+		// ctx is cancelled by Stop before it waits on produceWG, so a
+		// concurrent Stop unblocks this select and falls back to the
+		// spool instead of leaving the send blocked forever.
+		select {
+		case ch <- jsonCopy:
+		case <-ctx.Done():
+			fh.spoolOrDrop(jsonCopy)
+			return
+		}
+	}
+	fh.Lock.Lock()
+	fh.PerfStats.ForwardedPerSec++
+	fh.Lock.Unlock()
+}
+
 // GetName returns the name of the handler
 func (fh *ForwardHandler) GetName() string {
 	return "Forwarding handler"
@@ -197,32 +559,136 @@ func (fh *ForwardHandler) GetEventTypes() []string {
 	return util.GetAllowedTypes()
 }
 
-// Run starts forwarding of JSON representations of all consumed events
+// Run starts forwarding of JSON representations of all consumed events. It
+// is a no-op if the handler is already running.
 func (fh *ForwardHandler) Run() {
-	if !fh.Running {
-		fh.StopChan = make(chan bool)
-		fh.ForwardEventChan = make(chan []byte, 10000)
-		go fh.reconnectForward()
-		fh.ReconnectNotifyChan <- true
-		go fh.runForward()
-		go fh.runCounter()
-		fh.Running = true
+	fh.Lock.Lock()
+	if fh.Running {
+		fh.Lock.Unlock()
+		return
 	}
+	capacity := fh.ChanCapacity
+	if capacity <= 0 {
+		capacity = 10000
+	}
+	fh.ctx, fh.cancel = context.WithCancel(context.Background())
+	fh.ForwardEventChan = make(chan []byte, capacity)
+	fh.Running = true
+	ctx := fh.ctx
+	fh.Lock.Unlock()
+
+	// A previous Stop may have cancelled reconnectForward mid-reconnect,
+	// leaving Reconnecting set; clear it so this run can connect again.
+	fh.ReconnLock.Lock()
+	fh.Reconnecting = false
+	fh.ReconnLock.Unlock()
+
+	fh.wg.Add(3)
+	go fh.reconnectForward(ctx)
+	go fh.notifyReconnect(ctx)
+	go fh.runForward(ctx)
+	go fh.runCounter(ctx)
 }
 
-// Stop stops forwarding of JSON representations of all consumed events
+// Stop stops forwarding of JSON representations of all consumed events. It
+// flips Running (so that no further Consume call enqueues into
+// ForwardEventChan), cancels all of the handler's goroutines, waits for any
+// Consume call already past that check to finish enqueuing or fall back to
+// the spool, waits for the goroutines to exit, then drains any events left
+// in ForwardEventChan -- writing them live if the output connection is up,
+// or spooling (or dropping) them otherwise -- for up to StopDeadline
+// (DefaultForwardStopDeadline if unset) before giving up. Calling Stop on a
+// handler that isn't running just closes stoppedChan.
 func (fh *ForwardHandler) Stop(stoppedChan chan bool) {
-	if fh.Running {
-		fh.StoppedChan = stoppedChan
-		fh.Lock.Lock()
-		fh.OutputConn.Close()
+	fh.Lock.Lock()
+	if !fh.Running {
 		fh.Lock.Unlock()
-		close(fh.StopReconnectChan)
-		close(fh.ReconnectNotifyChan)
-		close(fh.StopChan)
-		close(fh.ForwardEventChan)
-		fh.Running = false
+		close(stoppedChan)
+		return
+	}
+	fh.Running = false
+	cancel := fh.cancel
+	ch := fh.ForwardEventChan
+	deadline := fh.StopDeadline
+	fh.Lock.Unlock()
+
+	cancel()
+	fh.produceWG.Wait()
+	fh.wg.Wait()
+
+	if deadline <= 0 {
+		deadline = DefaultForwardStopDeadline
+	}
+	fh.flushRemaining(ch, deadline)
+
+	fh.Lock.Lock()
+	if fh.OutputConn != nil {
+		fh.OutputConn.Close()
+	}
+	fh.Lock.Unlock()
+	if fh.Spool != nil {
+		fh.Spool.Close()
+	}
+	close(stoppedChan)
+}
+
+// flushRemaining drains ch, attempting a live write for each item (falling
+// back to the spool, or dropping, on failure) until ch is empty or deadline
+// elapses. Anything still queued once the deadline passes is shoved
+// straight into the spool (or dropped) without blocking further.
+func (fh *ForwardHandler) flushRemaining(ch chan []byte, deadline time.Duration) {
+	cutoff := time.Now().Add(deadline)
+	for {
+		remaining := time.Until(cutoff)
+		if remaining <= 0 {
+			break
+		}
+		select {
+		case item, ok := <-ch:
+			if !ok {
+				return
+			}
+			fh.flushItem(item)
+		default:
+			return
+		}
+		if time.Now().After(cutoff) {
+			break
+		}
+	}
+	for {
+		select {
+		case item, ok := <-ch:
+			if !ok {
+				return
+			}
+			fh.spoolOrDrop(item)
+		default:
+			return
+		}
+	}
+}
+
+// flushItem tries a direct write to the (possibly absent) output
+// connection, falling back to spoolOrDrop on any failure.
+func (fh *ForwardHandler) flushItem(item []byte) {
+	fh.Lock.Lock()
+	conn := fh.OutputConn
+	reconnecting := fh.Reconnecting
+	encoder := fh.Encoder
+	fh.Lock.Unlock()
+
+	if conn != nil && !reconnecting {
+		if encoder == nil {
+			encoder = NewlineJSONEncoder{}
+		}
+		if payload, err := encoder.EncodeBatch([][]byte{item}); err == nil {
+			if _, err := conn.Write(payload); err == nil {
+				return
+			}
+		}
 	}
+	fh.spoolOrDrop(item)
 }
 
 // SubmitStats registers a PerformanceStatsEncoder for runtime stats submission.
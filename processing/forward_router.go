@@ -0,0 +1,225 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, DCSO GmbH
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+
+	"github.com/DCSO/fever/types"
+	"github.com/DCSO/fever/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RoutePredicate decides whether an Entry should be dispatched to a given
+// ForwardRouter sink. An empty/nil field in the predicate is treated as
+// "unconstrained" on that dimension. A predicate with no constraints at all
+// matches every entry.
+type RoutePredicate struct {
+	// EventTypes, if non-empty, restricts matches to these event types.
+	EventTypes []string
+	// SrcCIDRs, if non-empty, requires the entry's src_ip to fall into one
+	// of these networks.
+	SrcCIDRs []*net.IPNet
+	// DstCIDRs, if non-empty, requires the entry's dest_ip to fall into one
+	// of these networks.
+	DstCIDRs []*net.IPNet
+	// SignatureIDMin/SignatureIDMax, if SignatureIDMax is non-zero,
+	// restricts matches to alert events whose alert.signature_id falls
+	// within [SignatureIDMin, SignatureIDMax].
+	SignatureIDMin uint64
+	SignatureIDMax uint64
+}
+
+// routeFields holds the subset of an Entry's JSON representation needed to
+// evaluate CIDR and signature ID predicates, parsed lazily and at most once
+// per Consume call regardless of how many sinks need it.
+type routeFields struct {
+	SrcIP string `json:"src_ip"`
+	DstIP string `json:"dest_ip"`
+	Alert struct {
+		SignatureID uint64 `json:"signature_id"`
+	} `json:"alert"`
+}
+
+func (rp *RoutePredicate) needsJSON() bool {
+	return len(rp.SrcCIDRs) > 0 || len(rp.DstCIDRs) > 0 || rp.SignatureIDMax > 0
+}
+
+func (rp *RoutePredicate) matches(e *types.Entry, fields *routeFields) bool {
+	if len(rp.EventTypes) > 0 {
+		var found bool
+		for _, t := range rp.EventTypes {
+			if t == e.EventType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !rp.needsJSON() {
+		return true
+	}
+	if len(rp.SrcCIDRs) > 0 && !matchesAnyCIDR(fields.SrcIP, rp.SrcCIDRs) {
+		return false
+	}
+	if len(rp.DstCIDRs) > 0 && !matchesAnyCIDR(fields.DstIP, rp.DstCIDRs) {
+		return false
+	}
+	if rp.SignatureIDMax > 0 {
+		sid := fields.Alert.SignatureID
+		if e.EventType != "alert" || sid < rp.SignatureIDMin || sid > rp.SignatureIDMax {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAnyCIDR(ip string, nets []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardRouterSink is one named destination of a ForwardRouter: a
+// RoutePredicate deciding which entries it receives, and the ForwardHandler
+// that owns its connection, encoding and spooling.
+type ForwardRouterSink struct {
+	Name      string
+	Predicate RoutePredicate
+	Handler   *ForwardHandler
+}
+
+// consume pushes a pre-copied JSON payload into the sink's handler, honoring
+// NonBlocking/Spool semantics without re-applying the handler's own
+// util.AllowType check (the router's RoutePredicate is the allow-list here).
+// It delegates to the handler's own enqueue so that the Stop/Consume
+// race-safety logic has a single implementation.
+func (s *ForwardRouterSink) consume(jsonCopy []byte) {
+	s.Handler.enqueue(jsonCopy)
+}
+
+// ForwardRouter fans a stream of entries out to a set of named sinks, each
+// with its own RoutePredicate, ForwardEncoder and connection. An entry is
+// dispatched to every sink whose predicate matches, so the same entry may
+// be delivered to more than one destination.
+type ForwardRouter struct {
+	Logger *log.Entry
+	Sinks  map[string]*ForwardRouterSink
+}
+
+// MakeForwardRouter creates an empty ForwardRouter. Use AddSink to register
+// destinations before calling Run.
+func MakeForwardRouter() *ForwardRouter {
+	return &ForwardRouter{
+		Logger: log.WithFields(log.Fields{
+			"domain": "forward-router",
+		}),
+		Sinks: make(map[string]*ForwardRouterSink),
+	}
+}
+
+// AddSink registers a named sink with the given predicate and handler. The
+// handler's PerfStats.Sink tag is set to name so that per-sink stats can be
+// told apart in InfluxDB.
+func (fr *ForwardRouter) AddSink(name string, predicate RoutePredicate, handler *ForwardHandler) {
+	handler.PerfStats.Sink = name
+	fr.Sinks[name] = &ForwardRouterSink{
+		Name:      name,
+		Predicate: predicate,
+		Handler:   handler,
+	}
+}
+
+// Consume evaluates every sink's RoutePredicate against e and dispatches a
+// copy of its JSON representation to each one that matches.
+func (fr *ForwardRouter) Consume(e *types.Entry) error {
+	var fields routeFields
+	var parsed bool
+	for _, sink := range fr.Sinks {
+		if sink.Predicate.needsJSON() && !parsed {
+			if err := json.Unmarshal(e.JSONLine, &fields); err != nil {
+				fr.Logger.Warnf("failed to parse entry for routing: %s", err)
+			}
+			parsed = true
+		}
+		if !sink.Predicate.matches(e, &fields) {
+			continue
+		}
+		jsonCopy := make([]byte, len(e.JSONLine))
+		copy(jsonCopy, e.JSONLine)
+		sink.consume(jsonCopy)
+	}
+	return nil
+}
+
+// GetName returns the name of the handler
+func (fr *ForwardRouter) GetName() string {
+	return "Forwarding router"
+}
+
+// GetEventTypes returns the union of event types accepted by any sink. A
+// sink with an unconstrained predicate (no EventTypes set) makes the whole
+// router accept all event types.
+func (fr *ForwardRouter) GetEventTypes() []string {
+	seen := make(map[string]bool)
+	for _, sink := range fr.Sinks {
+		if len(sink.Predicate.EventTypes) == 0 {
+			return []string{"*"}
+		}
+		for _, t := range sink.Predicate.EventTypes {
+			seen[t] = true
+		}
+	}
+	types := make([]string, 0, len(seen))
+	for t := range seen {
+		types = append(types, t)
+	}
+	return types
+}
+
+// Run starts every registered sink's ForwardHandler.
+func (fr *ForwardRouter) Run() {
+	for _, sink := range fr.Sinks {
+		sink.Handler.Run()
+	}
+}
+
+// Stop stops every registered sink's ForwardHandler and signals stoppedChan
+// once all of them have finished.
+func (fr *ForwardRouter) Stop(stoppedChan chan bool) {
+	var wg sync.WaitGroup
+	for _, sink := range fr.Sinks {
+		if !sink.Handler.Running {
+			continue
+		}
+		wg.Add(1)
+		go func(s *ForwardRouterSink) {
+			defer wg.Done()
+			sinkStopped := make(chan bool)
+			s.Handler.Stop(sinkStopped)
+			<-sinkStopped
+		}(sink)
+	}
+	wg.Wait()
+	close(stoppedChan)
+}
+
+// SubmitStats registers sc with every sink's ForwardHandler.
+func (fr *ForwardRouter) SubmitStats(sc *util.PerformanceStatsEncoder) {
+	for _, sink := range fr.Sinks {
+		sink.Handler.SubmitStats(sc)
+	}
+}
@@ -0,0 +1,100 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, DCSO GmbH
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DCSO/fever/types"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("parsing CIDR %q: %s", s, err)
+	}
+	return n
+}
+
+func TestRoutePredicateEventTypes(t *testing.T) {
+	rp := RoutePredicate{EventTypes: []string{"alert", "dns"}}
+	fields := &routeFields{}
+
+	if !rp.matches(&types.Entry{EventType: "alert"}, fields) {
+		t.Error("expected alert to match")
+	}
+	if rp.matches(&types.Entry{EventType: "flow"}, fields) {
+		t.Error("did not expect flow to match")
+	}
+}
+
+func TestRoutePredicateCIDR(t *testing.T) {
+	rp := RoutePredicate{SrcCIDRs: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}}
+	e := &types.Entry{EventType: "flow"}
+
+	if !rp.matches(e, &routeFields{SrcIP: "10.1.2.3"}) {
+		t.Error("expected 10.1.2.3 to match 10.0.0.0/8")
+	}
+	if rp.matches(e, &routeFields{SrcIP: "192.168.1.1"}) {
+		t.Error("did not expect 192.168.1.1 to match 10.0.0.0/8")
+	}
+	if rp.matches(e, &routeFields{SrcIP: "not-an-ip"}) {
+		t.Error("did not expect an unparseable IP to match")
+	}
+}
+
+func TestRoutePredicateSignatureIDRange(t *testing.T) {
+	rp := RoutePredicate{SignatureIDMin: 1000, SignatureIDMax: 2000}
+	e := &types.Entry{EventType: "alert"}
+
+	var in, below, above routeFields
+	in.Alert.SignatureID = 1500
+	below.Alert.SignatureID = 500
+	above.Alert.SignatureID = 2500
+
+	if !rp.matches(e, &in) {
+		t.Error("expected signature_id 1500 to match [1000,2000]")
+	}
+	if rp.matches(e, &below) {
+		t.Error("did not expect signature_id 500 to match [1000,2000]")
+	}
+	if rp.matches(e, &above) {
+		t.Error("did not expect signature_id 2500 to match [1000,2000]")
+	}
+}
+
+func TestRoutePredicateUnconstrainedMatchesEverything(t *testing.T) {
+	rp := RoutePredicate{}
+	if !rp.matches(&types.Entry{EventType: "anything"}, &routeFields{}) {
+		t.Error("expected an empty predicate to match every entry")
+	}
+}
+
+// TestForwardRouterSinkConsumeNotRunningSpools verifies that a sink whose
+// handler was never started (or was already stopped) spools events instead
+// of blocking on a nil/abandoned ForwardEventChan.
+func TestForwardRouterSinkConsumeNotRunningSpools(t *testing.T) {
+	fh := MakeForwardHandler(0, "/nonexistent/fever-router-test.sock")
+	spoolDir := t.TempDir()
+	if err := fh.SetSpoolDir(spoolDir, 1<<20, 1<<20, 0); err != nil {
+		t.Fatalf("SetSpoolDir: %s", err)
+	}
+
+	sink := &ForwardRouterSink{Name: "test", Handler: fh}
+
+	done := make(chan bool)
+	go func() {
+		sink.consume([]byte(`{"event_type":"flow"}`))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consume blocked instead of spooling for a non-running handler")
+	}
+}
@@ -0,0 +1,271 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, DCSO GmbH
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const spoolSegmentPrefix = "forward-"
+const spoolSegmentSuffix = ".seg"
+
+// DiskSpool is an on-disk, segmented, append-only buffer for forwarded
+// events. It is used by ForwardHandler to avoid losing events during
+// extended output outages: events that cannot be delivered (or queued) are
+// appended here and replayed, in order, once the output connection comes
+// back up. Segments are rotated once they reach MaxSegmentBytes, and the
+// oldest segments are evicted once the spool's total size exceeds MaxBytes.
+type DiskSpool struct {
+	Dir             string
+	MaxSegmentBytes int64
+	MaxBytes        int64
+	FsyncInterval   time.Duration
+
+	mutex      sync.Mutex
+	curFile    *os.File
+	curBytes   int64
+	totalBytes int64
+	segments   []string
+	stopFsync  chan bool
+	fsyncWg    sync.WaitGroup
+}
+
+// NewDiskSpool creates a spool rooted at dir, creating the directory if
+// necessary and picking up any segments left over from a previous run.
+func NewDiskSpool(dir string, maxSegmentBytes, maxBytes int64, fsyncInterval time.Duration) (*DiskSpool, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("creating spool directory %q: %w", dir, err)
+	}
+	ds := &DiskSpool{
+		Dir:             dir,
+		MaxSegmentBytes: maxSegmentBytes,
+		MaxBytes:        maxBytes,
+		FsyncInterval:   fsyncInterval,
+		stopFsync:       make(chan bool),
+	}
+	if err := ds.loadExistingSegments(); err != nil {
+		return nil, err
+	}
+	if fsyncInterval > 0 {
+		ds.fsyncWg.Add(1)
+		go ds.runFsync()
+	}
+	return ds, nil
+}
+
+func (ds *DiskSpool) loadExistingSegments() error {
+	entries, err := os.ReadDir(ds.Dir)
+	if err != nil {
+		return fmt.Errorf("reading spool directory %q: %w", ds.Dir, err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(e.Name(), spoolSegmentPrefix) && strings.HasSuffix(e.Name(), spoolSegmentSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	ds.segments = names
+	for _, n := range names {
+		fi, err := os.Stat(filepath.Join(ds.Dir, n))
+		if err == nil {
+			ds.totalBytes += fi.Size()
+		}
+	}
+	return nil
+}
+
+func (ds *DiskSpool) runFsync() {
+	defer ds.fsyncWg.Done()
+	ticker := time.NewTicker(ds.FsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ds.stopFsync:
+			return
+		case <-ticker.C:
+			ds.mutex.Lock()
+			if ds.curFile != nil {
+				ds.curFile.Sync()
+			}
+			ds.mutex.Unlock()
+		}
+	}
+}
+
+// Write appends item to the spool as a length-prefixed record, rotating to
+// a new segment if the current one has already reached MaxSegmentBytes (or, with
+// MaxSegmentBytes unset, if this record would push the spool over MaxBytes
+// -- otherwise the active segment would grow forever and evictLocked would
+// never have a prior segment to drop), and evicting the oldest segments if
+// the spool would exceed MaxBytes.
+func (ds *DiskSpool) Write(item []byte) error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	recordLen := int64(4 + len(item))
+	needsRotate := ds.curFile == nil ||
+		(ds.MaxSegmentBytes > 0 && ds.curBytes >= ds.MaxSegmentBytes) ||
+		(ds.MaxSegmentBytes == 0 && ds.MaxBytes > 0 && ds.curBytes > 0 && ds.totalBytes+recordLen > ds.MaxBytes)
+	if needsRotate {
+		if err := ds.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(item)))
+	n1, err := ds.curFile.Write(lenBuf[:])
+	if err != nil {
+		return fmt.Errorf("writing spool record length: %w", err)
+	}
+	n2, err := ds.curFile.Write(item)
+	if err != nil {
+		return fmt.Errorf("writing spool record: %w", err)
+	}
+	written := int64(n1 + n2)
+	ds.curBytes += written
+	ds.totalBytes += written
+
+	ds.evictLocked()
+	return nil
+}
+
+func (ds *DiskSpool) rotateLocked() error {
+	if ds.curFile != nil {
+		ds.curFile.Close()
+	}
+	name := fmt.Sprintf("%s%020d%s", spoolSegmentPrefix, time.Now().UnixNano(), spoolSegmentSuffix)
+	f, err := os.OpenFile(filepath.Join(ds.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("creating spool segment %q: %w", name, err)
+	}
+	ds.curFile = f
+	ds.curBytes = 0
+	ds.segments = append(ds.segments, name)
+	return nil
+}
+
+// evictLocked drops the oldest segments until the spool is back under
+// MaxBytes. Must be called with ds.mutex held.
+func (ds *DiskSpool) evictLocked() {
+	for ds.MaxBytes > 0 && ds.totalBytes > ds.MaxBytes && len(ds.segments) > 1 {
+		oldest := ds.segments[0]
+		path := filepath.Join(ds.Dir, oldest)
+		fi, err := os.Stat(path)
+		if err == nil {
+			ds.totalBytes -= fi.Size()
+		}
+		if err := os.Remove(path); err != nil {
+			log.WithFields(log.Fields{
+				"domain": "forward",
+				"file":   oldest,
+			}).Warnf("failed to evict spool segment: %s", err)
+		}
+		ds.segments = ds.segments[1:]
+	}
+}
+
+// Replay reads every spooled record, oldest first, passing each to fn. A
+// segment is deleted once fully consumed. If fn returns an error, replay
+// stops immediately and the unconsumed segments (including the partially
+// read one) are left in place for a later retry.
+func (ds *DiskSpool) Replay(fn func([]byte) error) error {
+	ds.mutex.Lock()
+	if ds.curFile != nil {
+		ds.curFile.Close()
+		ds.curFile = nil
+	}
+	segments := append([]string(nil), ds.segments...)
+	ds.mutex.Unlock()
+
+	for _, name := range segments {
+		path := filepath.Join(ds.Dir, name)
+		if err := ds.replaySegment(path, fn); err != nil {
+			return err
+		}
+		ds.mutex.Lock()
+		fi, statErr := os.Stat(path)
+		if statErr == nil {
+			ds.totalBytes -= fi.Size()
+		}
+		os.Remove(path)
+		if len(ds.segments) > 0 && ds.segments[0] == name {
+			ds.segments = ds.segments[1:]
+		}
+		ds.mutex.Unlock()
+	}
+	return nil
+}
+
+func (ds *DiskSpool) replaySegment(path string, fn func([]byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("opening spool segment %q: %w", path, err)
+	}
+	defer f.Close()
+
+	for {
+		var lenBuf [4]byte
+		_, err := io.ReadFull(f, lenBuf[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading spool record length from %q: %w", path, err)
+		}
+		recLen := binary.BigEndian.Uint32(lenBuf[:])
+		buf := make([]byte, recLen)
+		if _, err := io.ReadFull(f, buf); err != nil {
+			return fmt.Errorf("reading spool record from %q: %w", path, err)
+		}
+		if err := fn(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns the current total size, in bytes, of all spooled segments.
+func (ds *DiskSpool) Size() int64 {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	return ds.totalBytes
+}
+
+// Close stops the background fsync goroutine and closes the current
+// segment, if any.
+func (ds *DiskSpool) Close() error {
+	select {
+	case <-ds.stopFsync:
+		// already closed by an earlier Close
+	default:
+		close(ds.stopFsync)
+	}
+	ds.fsyncWg.Wait()
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	if ds.curFile != nil {
+		err := ds.curFile.Close()
+		ds.curFile = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, DCSO GmbH
+
+import (
+	"os"
+	"testing"
+)
+
+// TestDiskSpoolUnboundedSegmentSize verifies that MaxSegmentBytes == 0 (the
+// "unbounded" convention used elsewhere in DiskSpool) keeps appending to a
+// single segment instead of rotating on every write.
+func TestDiskSpoolUnboundedSegmentSize(t *testing.T) {
+	ds, err := NewDiskSpool(t.TempDir(), 0, 0, 0)
+	if err != nil {
+		t.Fatalf("NewDiskSpool: %s", err)
+	}
+	defer ds.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := ds.Write([]byte("event")); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+	}
+
+	entries, err := os.ReadDir(ds.Dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected a single segment file with MaxSegmentBytes=0, got %d", len(entries))
+	}
+}
+
+// TestDiskSpoolRotatesOnSize verifies that a positive MaxSegmentBytes does
+// force rotation once a segment grows past it.
+func TestDiskSpoolRotatesOnSize(t *testing.T) {
+	ds, err := NewDiskSpool(t.TempDir(), 1, 0, 0)
+	if err != nil {
+		t.Fatalf("NewDiskSpool: %s", err)
+	}
+	defer ds.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := ds.Write([]byte("event")); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+	}
+
+	entries, err := os.ReadDir(ds.Dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("expected one segment per write with MaxSegmentBytes=1, got %d", len(entries))
+	}
+}
+
+// TestDiskSpoolEvictsOldestOverQuota verifies that once total spool size
+// exceeds MaxBytes, the oldest segments are dropped first.
+func TestDiskSpoolEvictsOldestOverQuota(t *testing.T) {
+	ds, err := NewDiskSpool(t.TempDir(), 1, 20, 0)
+	if err != nil {
+		t.Fatalf("NewDiskSpool: %s", err)
+	}
+	defer ds.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := ds.Write([]byte("event")); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+	}
+
+	if ds.Size() > 20 {
+		t.Fatalf("spool size %d exceeds MaxBytes=20 after eviction", ds.Size())
+	}
+	entries, err := os.ReadDir(ds.Dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	if len(entries) >= 10 {
+		t.Fatalf("expected older segments to have been evicted, found %d", len(entries))
+	}
+}
+
+// TestDiskSpoolEvictsOverQuotaWithUnboundedSegments verifies that MaxBytes is
+// still enforced when MaxSegmentBytes is 0 (unbounded): Write must force its
+// own rotation in that case, otherwise there is never more than one segment
+// for evictLocked to drop and the quota goes unenforced.
+func TestDiskSpoolEvictsOverQuotaWithUnboundedSegments(t *testing.T) {
+	ds, err := NewDiskSpool(t.TempDir(), 0, 50, 0)
+	if err != nil {
+		t.Fatalf("NewDiskSpool: %s", err)
+	}
+	defer ds.Close()
+
+	for i := 0; i < 50; i++ {
+		if err := ds.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+	}
+
+	if ds.Size() > 50 {
+		t.Fatalf("spool size %d exceeds MaxBytes=50 with MaxSegmentBytes=0", ds.Size())
+	}
+}
+
+// TestDiskSpoolReplayInOrder verifies that Replay delivers every written
+// event in the order it was written, and removes the consumed segments.
+func TestDiskSpoolReplayInOrder(t *testing.T) {
+	ds, err := NewDiskSpool(t.TempDir(), 1, 0, 0)
+	if err != nil {
+		t.Fatalf("NewDiskSpool: %s", err)
+	}
+	defer ds.Close()
+
+	want := []string{"one", "two", "three"}
+	for _, w := range want {
+		if err := ds.Write([]byte(w)); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+	}
+
+	var got []string
+	err = ds.Replay(func(item []byte) error {
+		got = append(got, string(item))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %s", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d replayed events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("replay order mismatch at %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+	if ds.Size() != 0 {
+		t.Fatalf("expected spool to be empty after full replay, got size %d", ds.Size())
+	}
+}
@@ -0,0 +1,87 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, DCSO GmbH
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseOutputURLUnix(t *testing.T) {
+	socketPath, closeListener := discardListener(t)
+	defer closeListener()
+
+	dial, err := parseOutputURL("unix://" + socketPath)
+	if err != nil {
+		t.Fatalf("parseOutputURL: %s", err)
+	}
+	conn, err := dial()
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	conn.Close()
+}
+
+func TestParseOutputURLTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	dial, err := parseOutputURL("tcp://" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("parseOutputURL: %s", err)
+	}
+	conn, err := dial()
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	conn.Close()
+}
+
+func TestParseOutputURLTLSMissingCA(t *testing.T) {
+	// A tls:// URL pointing at a nonexistent CA file should fail at parse
+	// time (building the tls.Config), not at dial time.
+	_, err := parseOutputURL("tls://example.invalid:1234?ca=" + filepath.Join(t.TempDir(), "no-such-ca.pem"))
+	if err == nil {
+		t.Fatal("expected an error for a missing CA file")
+	}
+}
+
+func TestParseOutputURLUnsupportedScheme(t *testing.T) {
+	if _, err := parseOutputURL("ftp://example.invalid"); err == nil {
+		t.Fatal("expected an error for an unsupported scheme")
+	}
+}
+
+func TestMakeTLSConfigDefaults(t *testing.T) {
+	cfg, err := makeTLSConfig(ForwardTLSConfig{})
+	if err != nil {
+		t.Fatalf("makeTLSConfig: %s", err)
+	}
+	if !cfg.InsecureSkipVerify {
+		t.Error("expected InsecureSkipVerify to default true when VerifyPeer is unset")
+	}
+}
+
+func TestMakeTLSConfigVerifyPeer(t *testing.T) {
+	cfg, err := makeTLSConfig(ForwardTLSConfig{VerifyPeer: true})
+	if err != nil {
+		t.Fatalf("makeTLSConfig: %s", err)
+	}
+	if cfg.InsecureSkipVerify {
+		t.Error("expected InsecureSkipVerify to be false when VerifyPeer is set")
+	}
+}
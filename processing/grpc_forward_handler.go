@@ -0,0 +1,495 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, DCSO GmbH
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/DCSO/fever/rpc"
+	"github.com/DCSO/fever/types"
+	"github.com/DCSO/fever/util"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+// GRPCForwardHandlerPerfStats contains performance counters of a
+// GRPCForwardHandler. The handler does not submit them to InfluxDB and does
+// not reset them; they only accumulate.
+type GRPCForwardHandlerPerfStats struct {
+	ForwardedPerSec uint64 `influx:"forwarded_events_per_sec"`
+	AckedPerSec     uint64 `influx:"acked_events_per_sec"`
+}
+
+// GRPCForwardHandler is a handler that streams consumed events to a remote
+// rpc.EntryForwarder service over a bidirectional gRPC stream, instead of
+// writing to a socket directly. Acks received on the stream advance
+// LastAckedSeq. Events that could not be sent are written to the Spool (if
+// set) and replayed on reconnect; batches that were sent but not yet acked
+// are not kept, so they are not resent after the stream breaks.
+type GRPCForwardHandler struct {
+	Logger      *log.Entry
+	Endpoint    string
+	TLSConfig   *ForwardTLSConfig
+	Keepalive   keepalive.ClientParameters
+	BatchSize   int
+	Spool       *DiskSpool
+	NonBlocking bool
+
+	ForwardEventChan chan []byte
+	LastSeq          uint64
+	LastAckedSeq     uint64
+
+	conn   *grpc.ClientConn
+	client rpc.EntryForwarderClient
+	stream rpc.EntryForwarder_StreamEntriesClient
+
+	// sendLock serializes stream.Send calls: grpc-go forbids calling SendMsg
+	// concurrently on the same ClientStream, and both replaySpool (from
+	// connect) and runSend can otherwise race to send on a freshly
+	// established stream.
+	sendLock sync.Mutex
+
+	PerfStats    GRPCForwardHandlerPerfStats
+	StatsEncoder *util.PerformanceStatsEncoder
+
+	Lock    sync.Mutex
+	Running bool
+
+	ctx             context.Context
+	cancel          context.CancelFunc
+	wg              sync.WaitGroup
+	produceWG       sync.WaitGroup
+	reconnectNotify chan bool
+}
+
+// MakeGRPCForwardHandler creates a new handler streaming events to the
+// rpc.EntryForwarder service at endpoint (host:port). If tlsConfig is nil
+// the connection is made in plaintext.
+func MakeGRPCForwardHandler(endpoint string, tlsConfig *ForwardTLSConfig) *GRPCForwardHandler {
+	return &GRPCForwardHandler{
+		Logger: log.WithFields(log.Fields{
+			"domain": "forward-grpc",
+		}),
+		Endpoint:  endpoint,
+		TLSConfig: tlsConfig,
+		Keepalive: keepalive.ClientParameters{
+			Time:                20 * time.Second,
+			Timeout:             5 * time.Second,
+			PermitWithoutStream: true,
+		},
+		BatchSize: 1,
+	}
+}
+
+func (gh *GRPCForwardHandler) dialOptions() ([]grpc.DialOption, error) {
+	var creds credentials.TransportCredentials
+	if gh.TLSConfig != nil {
+		tlsCfg, err := makeTLSConfig(*gh.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(tlsCfg)
+	} else {
+		creds = insecure.NewCredentials()
+	}
+	return []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithKeepaliveParams(gh.Keepalive),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.DefaultConfig,
+		}),
+	}, nil
+}
+
+// connect dials the endpoint and opens the bidirectional stream, bound to
+// ctx so that the stream is torn down when the handler is stopped. The new
+// stream is published under sendLock, held for the duration of the replay,
+// so that runSend cannot interleave a Send call with replaySpool's on the
+// same stream -- grpc-go forbids concurrent SendMsg calls on one
+// ClientStream.
+func (gh *GRPCForwardHandler) connect(ctx context.Context) error {
+	opts, err := gh.dialOptions()
+	if err != nil {
+		return err
+	}
+	conn, err := grpc.Dial(gh.Endpoint, opts...)
+	if err != nil {
+		return err
+	}
+	client := rpc.NewEntryForwarderClient(conn)
+	stream, err := client.StreamEntries(ctx)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	gh.sendLock.Lock()
+	defer gh.sendLock.Unlock()
+
+	gh.Lock.Lock()
+	oldConn := gh.conn
+	gh.conn = conn
+	gh.client = client
+	gh.stream = stream
+	gh.Lock.Unlock()
+	if oldConn != nil {
+		oldConn.Close()
+	}
+	gh.replaySpool(stream)
+	return nil
+}
+
+// replaySpool drains any events buffered on disk into stream before regular
+// forwarding resumes, so that a reconnect delivers previously unsendable
+// events at least once. Events are streamed directly (bypassing
+// ForwardEventChan) so that replay cannot itself fill up the spool again.
+// Callers must hold sendLock.
+func (gh *GRPCForwardHandler) replaySpool(stream rpc.EntryForwarder_StreamEntriesClient) {
+	if gh.Spool == nil {
+		return
+	}
+	err := gh.Spool.Replay(func(item []byte) error {
+		entries, err := entriesToProto([][]byte{item})
+		if err != nil {
+			return err
+		}
+		gh.Lock.Lock()
+		gh.LastSeq++
+		seq := gh.LastSeq
+		gh.Lock.Unlock()
+		return stream.Send(&rpc.EntryBatch{Seq: seq, Entries: entries})
+	})
+	if err != nil {
+		gh.Logger.Warnf("spool replay interrupted, will retry on next reconnect: %s", err)
+	}
+}
+
+// runRecv reads Acks off the stream and advances LastAckedSeq, logging and
+// triggering a reconnect if the stream breaks or was never established.
+func (gh *GRPCForwardHandler) runRecv() {
+	defer gh.wg.Done()
+	for {
+		gh.Lock.Lock()
+		stream := gh.stream
+		gh.Lock.Unlock()
+		if stream == nil {
+			if !gh.awaitReconnect(stream) {
+				return
+			}
+			continue
+		}
+		ack, err := stream.Recv()
+		if err != nil {
+			select {
+			case <-gh.ctx.Done():
+				return
+			default:
+			}
+			gh.Logger.Warnf("gRPC forward stream receive error: %s", err)
+			// Clear the shared stream as soon as the break is known:
+			// stream.Send on a dead connection commonly still reports
+			// success (it only enqueues onto the local flow-control
+			// buffer), so runSend can't rely on its own Send error to
+			// learn this -- it must see gh.stream go nil instead.
+			gh.Lock.Lock()
+			if gh.stream == stream {
+				gh.stream = nil
+			}
+			gh.Lock.Unlock()
+			if !gh.awaitReconnect(stream) {
+				return
+			}
+			continue
+		}
+		gh.Lock.Lock()
+		if ack.Seq > gh.LastAckedSeq {
+			gh.LastAckedSeq = ack.Seq
+		}
+		gh.PerfStats.AckedPerSec++
+		gh.Lock.Unlock()
+	}
+}
+
+// runReconnect is the single goroutine responsible for (re-)dialing the
+// endpoint, so that runRecv and runSend noticing the same broken connection
+// never race each other into dialing twice. It waits for a notification on
+// reconnectNotify, then retries connect() with a fixed delay until it
+// succeeds or the handler's context is cancelled.
+func (gh *GRPCForwardHandler) runReconnect(ctx context.Context) {
+	defer gh.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-gh.reconnectNotify:
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			if err := gh.connect(ctx); err != nil {
+				gh.Logger.Warnf("error reconnecting gRPC forward stream: %s", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(5 * time.Second):
+				}
+				continue
+			}
+			break
+		}
+		// runRecv and runSend can both have noticed the same broken
+		// connection and each queued a notification before connect()
+		// above replaced gh.stream. Drain any such stale notify now,
+		// rather than redialing again next iteration and leaking the
+		// *grpc.ClientConn we just established.
+		select {
+		case <-gh.reconnectNotify:
+		default:
+		}
+	}
+}
+
+// awaitReconnect notifies runReconnect that the connection identified by
+// staleStream is broken (or was never established) and waits until a new
+// stream has replaced it, or the handler's context is cancelled -- in which
+// case it returns false.
+func (gh *GRPCForwardHandler) awaitReconnect(staleStream rpc.EntryForwarder_StreamEntriesClient) bool {
+	gh.Lock.Lock()
+	alreadyReplaced := gh.stream != nil && gh.stream != staleStream
+	gh.Lock.Unlock()
+	if !alreadyReplaced {
+		select {
+		case gh.reconnectNotify <- true:
+		case <-gh.ctx.Done():
+			return false
+		}
+	}
+	for {
+		gh.Lock.Lock()
+		current := gh.stream
+		gh.Lock.Unlock()
+		if current != nil && current != staleStream {
+			return true
+		}
+		select {
+		case <-gh.ctx.Done():
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (gh *GRPCForwardHandler) runSend() {
+	defer gh.wg.Done()
+	limit := gh.BatchSize
+	if limit < 1 {
+		limit = 1
+	}
+	for {
+		var item []byte
+		select {
+		case <-gh.ctx.Done():
+			return
+		case it, ok := <-gh.ForwardEventChan:
+			if !ok {
+				return
+			}
+			item = it
+		}
+		batch := collectBatch(gh.ForwardEventChan, item, limit)
+
+		gh.Lock.Lock()
+		gh.LastSeq += uint64(len(batch))
+		seq := gh.LastSeq
+		stream := gh.stream
+		gh.Lock.Unlock()
+
+		if stream == nil {
+			gh.spoolOrDrop(batch)
+			if !gh.awaitReconnect(stream) {
+				return
+			}
+			continue
+		}
+		entries, err := entriesToProto(batch)
+		if err != nil {
+			gh.Logger.Warnf("failed to encode forward batch: %s", err)
+			gh.spoolOrDrop(batch)
+			continue
+		}
+		gh.sendLock.Lock()
+		err = stream.Send(&rpc.EntryBatch{Seq: seq, Entries: entries})
+		gh.sendLock.Unlock()
+		if err != nil {
+			gh.Logger.Warnf("gRPC forward stream send error: %s", err)
+			gh.spoolOrDrop(batch)
+			if !gh.awaitReconnect(stream) {
+				return
+			}
+			continue
+		}
+		gh.Lock.Lock()
+		gh.PerfStats.ForwardedPerSec += uint64(len(batch))
+		gh.Lock.Unlock()
+	}
+}
+
+func (gh *GRPCForwardHandler) spoolOrDrop(batch [][]byte) {
+	if gh.Spool == nil {
+		return
+	}
+	for _, item := range batch {
+		if err := gh.Spool.Write(item); err != nil {
+			gh.Logger.Warnf("failed to spool event to disk: %s", err)
+		}
+	}
+}
+
+// Consume processes an Entry and forwards it over the gRPC stream. The
+// running check and produceWG.Add happen in the same critical section as
+// Stop's own Running flip, so that Stop can never start draining
+// ForwardEventChan while a Consume call that saw Running == true hasn't yet
+// enqueued (or bailed out) -- see produceWG.Wait in Stop.
+func (gh *GRPCForwardHandler) Consume(e *types.Entry) error {
+	doForwardThis := util.ForwardAllEvents || util.AllowType(e.EventType)
+	if doForwardThis {
+		jsonCopy := make([]byte, len(e.JSONLine))
+		copy(jsonCopy, e.JSONLine)
+
+		gh.Lock.Lock()
+		if !gh.Running {
+			gh.Lock.Unlock()
+			gh.spoolOrDrop([][]byte{jsonCopy})
+			return nil
+		}
+		gh.produceWG.Add(1)
+		ch := gh.ForwardEventChan
+		ctx := gh.ctx
+		gh.Lock.Unlock()
+		defer gh.produceWG.Done()
+
+		if gh.NonBlocking {
+			select {
+			case ch <- jsonCopy:
+			default:
+				gh.spoolOrDrop([][]byte{jsonCopy})
+			}
+		} else {
+			// ctx is cancelled by Stop before it waits on produceWG, so a
+			// concurrent Stop unblocks this select and falls back to the
+			// spool instead of leaving the send blocked forever.
+			select {
+			case ch <- jsonCopy:
+			case <-ctx.Done():
+				gh.spoolOrDrop([][]byte{jsonCopy})
+			}
+		}
+	}
+	return nil
+}
+
+// GetName returns the name of the handler
+func (gh *GRPCForwardHandler) GetName() string {
+	return "gRPC forwarding handler"
+}
+
+// GetEventTypes returns a slice of event type strings that this handler
+// should be applied to
+func (gh *GRPCForwardHandler) GetEventTypes() []string {
+	if util.ForwardAllEvents {
+		return []string{"*"}
+	}
+	return util.GetAllowedTypes()
+}
+
+// Run starts streaming of JSON representations of all consumed events to
+// the configured gRPC endpoint. A failed initial connect is not fatal: both
+// runRecv and runSend fall back to awaitReconnect whenever they find the
+// stream unset, so the handler keeps retrying in the background.
+func (gh *GRPCForwardHandler) Run() {
+	gh.Lock.Lock()
+	if gh.Running {
+		gh.Lock.Unlock()
+		return
+	}
+	gh.ctx, gh.cancel = context.WithCancel(context.Background())
+	gh.ForwardEventChan = make(chan []byte, 10000)
+	gh.reconnectNotify = make(chan bool, 1)
+	gh.Running = true
+	ctx := gh.ctx
+	gh.Lock.Unlock()
+
+	gh.wg.Add(3)
+	go gh.runReconnect(ctx)
+	if err := gh.connect(ctx); err != nil {
+		gh.Logger.Warnf("initial gRPC connect failed, will retry: %s", err)
+		select {
+		case gh.reconnectNotify <- true:
+		default:
+		}
+	}
+	go gh.runRecv()
+	go gh.runSend()
+}
+
+// Stop stops streaming of JSON representations of all consumed events. It
+// flips Running, cancels all of the handler's goroutines, waits for any
+// Consume call already past the running check to finish enqueuing or fall
+// back to the spool, waits for runRecv/runSend to exit, then spools
+// whatever is left in ForwardEventChan and closes the connection.
+func (gh *GRPCForwardHandler) Stop(stoppedChan chan bool) {
+	gh.Lock.Lock()
+	if !gh.Running {
+		gh.Lock.Unlock()
+		close(stoppedChan)
+		return
+	}
+	gh.Running = false
+	cancel := gh.cancel
+	ch := gh.ForwardEventChan
+	gh.Lock.Unlock()
+
+	cancel()
+	gh.produceWG.Wait()
+	gh.wg.Wait()
+
+drain:
+	for {
+		select {
+		case item, ok := <-ch:
+			if !ok {
+				break drain
+			}
+			gh.spoolOrDrop([][]byte{item})
+		default:
+			break drain
+		}
+	}
+
+	gh.Lock.Lock()
+	if gh.conn != nil {
+		gh.conn.Close()
+	}
+	gh.Lock.Unlock()
+	if gh.Spool != nil {
+		gh.Spool.Close()
+	}
+	close(stoppedChan)
+}
+
+// SubmitStats stores sc as the handler's StatsEncoder. The handler does not
+// submit its PerfStats through it.
+func (gh *GRPCForwardHandler) SubmitStats(sc *util.PerformanceStatsEncoder) {
+	gh.StatsEncoder = sc
+}
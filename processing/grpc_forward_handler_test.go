@@ -0,0 +1,70 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, DCSO GmbH
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DCSO/fever/types"
+)
+
+// TestGRPCForwardHandlerConsumeNotRunningSpools verifies that Consume spools
+// events instead of blocking or panicking when the handler hasn't been
+// started (ForwardEventChan is nil) or has already been stopped.
+func TestGRPCForwardHandlerConsumeNotRunningSpools(t *testing.T) {
+	gh := MakeGRPCForwardHandler("127.0.0.1:0", nil)
+	spoolDir := t.TempDir()
+	spool, err := NewDiskSpool(spoolDir, 1<<20, 1<<20, 0)
+	if err != nil {
+		t.Fatalf("NewDiskSpool: %s", err)
+	}
+	gh.Spool = spool
+	defer spool.Close()
+
+	done := make(chan bool)
+	go func() {
+		err := gh.Consume(&types.Entry{EventType: "flow", JSONLine: []byte(`{"event_type":"flow"}`)})
+		if err != nil {
+			t.Errorf("Consume: %s", err)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Consume blocked instead of spooling for a non-running handler")
+	}
+
+	if spool.Size() == 0 {
+		t.Error("expected the event to have been spooled")
+	}
+}
+
+// TestGRPCForwardHandlerRapidRunStopCycles hammers Run/Stop back to back
+// against an endpoint that refuses connections, to catch nil-deref,
+// deadlocks or send-on-closed-channel panics in the reconnect machinery.
+func TestGRPCForwardHandlerRapidRunStopCycles(t *testing.T) {
+	gh := MakeGRPCForwardHandler("127.0.0.1:1", nil)
+	for i := 0; i < 5; i++ {
+		gh.Run()
+		stopped := make(chan bool)
+		done := make(chan bool)
+		go func() {
+			gh.Stop(stopped)
+			close(done)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Stop did not close stoppedChan in time")
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Stop did not return in time")
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Hand-written to mirror entry.proto: this repo has no protoc/buf toolchain
+// to generate from it, so the message types and their Marshal/Unmarshal
+// methods below must be kept in sync by hand whenever entry.proto changes.
+
+package rpc
+
+// DCSO FEVER
+// Copyright (c) 2017, DCSO GmbH
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Entry mirrors the fields of types.Entry used by forwarding consumers, as
+// defined in entry.proto.
+type Entry struct {
+	EventType string
+	JSONLine  []byte
+}
+
+// EntryBatch wraps a batch of forwarded events, as defined in entry.proto.
+type EntryBatch struct {
+	Seq     uint64
+	Entries []*Entry
+}
+
+// Ack acknowledges cumulative delivery of every event up to and including
+// Seq, as defined in entry.proto.
+type Ack struct {
+	Seq uint64
+}
+
+// Marshal encodes the message using standard protobuf wire format.
+func (m *Entry) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	if m.EventType != "" {
+		writeTag(&buf, 1, 2)
+		writeVarint(&buf, uint64(len(m.EventType)))
+		buf.WriteString(m.EventType)
+	}
+	if len(m.JSONLine) > 0 {
+		writeTag(&buf, 2, 2)
+		writeVarint(&buf, uint64(len(m.JSONLine)))
+		buf.Write(m.JSONLine)
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the message using standard protobuf wire format.
+func (m *Entry) Unmarshal(data []byte) error {
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		field, wireType, err := readTag(r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == 2:
+			b, err := readBytes(r)
+			if err != nil {
+				return err
+			}
+			m.EventType = string(b)
+		case field == 2 && wireType == 2:
+			b, err := readBytes(r)
+			if err != nil {
+				return err
+			}
+			m.JSONLine = b
+		default:
+			if err := skipField(r, wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Marshal encodes the message using standard protobuf wire format.
+func (m *EntryBatch) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	if m.Seq != 0 {
+		writeTag(&buf, 1, 0)
+		writeVarint(&buf, m.Seq)
+	}
+	for _, e := range m.Entries {
+		b, err := e.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		writeTag(&buf, 2, 2)
+		writeVarint(&buf, uint64(len(b)))
+		buf.Write(b)
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the message using standard protobuf wire format.
+func (m *EntryBatch) Unmarshal(data []byte) error {
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		field, wireType, err := readTag(r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == 0:
+			v, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			m.Seq = v
+		case field == 2 && wireType == 2:
+			b, err := readBytes(r)
+			if err != nil {
+				return err
+			}
+			e := &Entry{}
+			if err := e.Unmarshal(b); err != nil {
+				return err
+			}
+			m.Entries = append(m.Entries, e)
+		default:
+			if err := skipField(r, wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Marshal encodes the message using standard protobuf wire format.
+func (m *Ack) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	if m.Seq != 0 {
+		writeTag(&buf, 1, 0)
+		writeVarint(&buf, m.Seq)
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the message using standard protobuf wire format.
+func (m *Ack) Unmarshal(data []byte) error {
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		field, wireType, err := readTag(r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == 0:
+			v, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			m.Seq = v
+		default:
+			if err := skipField(r, wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeTag(buf *bytes.Buffer, field int, wireType int) {
+	writeVarint(buf, uint64(field)<<3|uint64(wireType))
+}
+
+func writeVarint(buf *bytes.Buffer, v uint64) {
+	for v >= 0x80 {
+		buf.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	buf.WriteByte(byte(v))
+}
+
+func readTag(r *bytes.Reader) (field int, wireType int, err error) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(v >> 3), int(v & 0x7), nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func skipField(r *bytes.Reader, wireType int) error {
+	switch wireType {
+	case 0:
+		_, err := binary.ReadUvarint(r)
+		return err
+	case 2:
+		_, err := readBytes(r)
+		return err
+	default:
+		return fmt.Errorf("rpc: unsupported wire type %d", wireType)
+	}
+}
@@ -0,0 +1,150 @@
+// Hand-written to mirror entry.proto: this repo has no protoc/buf toolchain
+// to generate from it, so the client/server stubs below must be kept in
+// sync by hand whenever entry.proto's service definition changes.
+
+package rpc
+
+// DCSO FEVER
+// Copyright (c) 2017, DCSO GmbH
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+const codecName = "fever-proto"
+
+// codec (de)serializes EntryBatch/Ack using our hand-rolled protobuf wire
+// encoding, registered under codecName so callers can select it via
+// grpc.CallContentSubtype without depending on the full protobuf-go
+// reflection runtime.
+type codec struct{}
+
+func (codec) Name() string { return codecName }
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(interface{ Marshal() ([]byte, error) })
+	if !ok {
+		return nil, fmt.Errorf("rpc: %T does not support marshaling", v)
+	}
+	return m.Marshal()
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(interface{ Unmarshal([]byte) error })
+	if !ok {
+		return fmt.Errorf("rpc: %T does not support unmarshaling", v)
+	}
+	return m.Unmarshal(data)
+}
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+// EntryForwarderClient is the client API for EntryForwarder, as defined in
+// entry.proto.
+type EntryForwarderClient interface {
+	StreamEntries(ctx context.Context, opts ...grpc.CallOption) (EntryForwarder_StreamEntriesClient, error)
+}
+
+type entryForwarderClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewEntryForwarderClient creates a client stub for the EntryForwarder
+// service over cc, using the fever-proto codec.
+func NewEntryForwarderClient(cc *grpc.ClientConn) EntryForwarderClient {
+	return &entryForwarderClient{cc}
+}
+
+func (c *entryForwarderClient) StreamEntries(ctx context.Context, opts ...grpc.CallOption) (EntryForwarder_StreamEntriesClient, error) {
+	opts = append(opts, grpc.CallContentSubtype(codecName))
+	stream, err := c.cc.NewStream(ctx, &_EntryForwarder_serviceDesc.Streams[0], "/rpc.EntryForwarder/StreamEntries", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &entryForwarderStreamEntriesClient{stream}, nil
+}
+
+// EntryForwarder_StreamEntriesClient is the client-side stream for
+// EntryForwarder.StreamEntries.
+type EntryForwarder_StreamEntriesClient interface {
+	Send(*EntryBatch) error
+	Recv() (*Ack, error)
+	grpc.ClientStream
+}
+
+type entryForwarderStreamEntriesClient struct {
+	grpc.ClientStream
+}
+
+func (x *entryForwarderStreamEntriesClient) Send(m *EntryBatch) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *entryForwarderStreamEntriesClient) Recv() (*Ack, error) {
+	m := new(Ack)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// EntryForwarderServer is the server API for EntryForwarder, as defined in
+// entry.proto.
+type EntryForwarderServer interface {
+	StreamEntries(EntryForwarder_StreamEntriesServer) error
+}
+
+// EntryForwarder_StreamEntriesServer is the server-side stream for
+// EntryForwarder.StreamEntries.
+type EntryForwarder_StreamEntriesServer interface {
+	Send(*Ack) error
+	Recv() (*EntryBatch, error)
+	grpc.ServerStream
+}
+
+type entryForwarderStreamEntriesServer struct {
+	grpc.ServerStream
+}
+
+func (x *entryForwarderStreamEntriesServer) Send(m *Ack) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *entryForwarderStreamEntriesServer) Recv() (*EntryBatch, error) {
+	m := new(EntryBatch)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _EntryForwarder_StreamEntries_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(EntryForwarderServer).StreamEntries(&entryForwarderStreamEntriesServer{stream})
+}
+
+// RegisterEntryForwarderServer registers srv as the implementation backing
+// the EntryForwarder service on s.
+func RegisterEntryForwarderServer(s grpc.ServiceRegistrar, srv EntryForwarderServer) {
+	s.RegisterService(&_EntryForwarder_serviceDesc, srv)
+}
+
+var _EntryForwarder_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "rpc.EntryForwarder",
+	HandlerType: (*EntryForwarderServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamEntries",
+			Handler:       _EntryForwarder_StreamEntries_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "entry.proto",
+}